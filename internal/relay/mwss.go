@@ -3,70 +3,264 @@ package relay
 import (
 	"context"
 	"crypto/tls"
+	"math/rand"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
-	"github.com/xtaci/smux"
+	"golang.org/x/sync/singleflight"
 )
 
+const (
+	// DefaultMWSSPath is the upgrade endpoint used when a relay does not
+	// override it via config, kept for backward compatibility.
+	DefaultMWSSPath = "/tcp/"
+
+	// MinMWSSStreamCnt / MaxMWSSStreamCntLimit bound the user-configurable
+	// MaxStreamCnt on a relay's MWSS config.
+	MinMWSSStreamCnt      = 1
+	MaxMWSSStreamCntLimit = 16
+
+	// mwssKeepAliveInterval / mwssKeepAliveTimeout make smux probe the peer
+	// so a dead tunnel is noticed without waiting for a failed Dial.
+	mwssKeepAliveInterval = 10 * time.Second
+	mwssKeepAliveTimeout  = 30 * time.Second
+
+	// initSessionBackoffMin / initSessionBackoffMax bound the full-jitter
+	// backoff between initSession retries; initSessionMaxRetries caps how
+	// many times a single Dial will retry before giving up.
+	initSessionBackoffMin = 100 * time.Millisecond
+	initSessionBackoffMax = 5 * time.Second
+	initSessionMaxRetries = 5
+
+	// mwssMetricsLogInterval is how often the session pool logs its health
+	// counters via Logger, so tunnel flapping shows up in logs without
+	// needing a separate metrics scrape endpoint.
+	mwssMetricsLogInterval = 1 * time.Minute
+)
+
+// mwssMetrics counts pool health events so operators can alert on tunnel
+// flapping. All fields are updated via sync/atomic.
+type mwssMetrics struct {
+	sessionsOpen       int64
+	reconnects         int64
+	streamOpenFailures int64
+}
+
 type mwssTransporter struct {
 	sessions     map[string][]*muxSession
 	sessionMutex sync.Mutex
+	dialGroup    singleflight.Group
+	metrics      mwssMetrics
 }
 
 func NewMWSSTransporter() *mwssTransporter {
-	return &mwssTransporter{
+	tr := &mwssTransporter{
 		sessions: make(map[string][]*muxSession),
 	}
+	go tr.logMetricsPeriodically()
+	return tr
 }
 
-func (tr *mwssTransporter) Dial(addr string) (conn net.Conn, err error) {
-	tr.sessionMutex.Lock()
-	defer tr.sessionMutex.Unlock()
+// Metrics returns a point-in-time snapshot of the session pool's health
+// counters: sessions currently open, reconnect attempts, and stream-open
+// failures.
+func (tr *mwssTransporter) Metrics() (sessionsOpen, reconnects, streamOpenFailures int64) {
+	return atomic.LoadInt64(&tr.metrics.sessionsOpen),
+		atomic.LoadInt64(&tr.metrics.reconnects),
+		atomic.LoadInt64(&tr.metrics.streamOpenFailures)
+}
 
-	var session *muxSession
-	var sessionIndex int
-	sessions, ok := tr.sessions[addr]
+// logMetricsPeriodically is Metrics' only consumer for now: it logs the
+// pool's health counters on a fixed interval so operators watching logs
+// can alert on tunnel flapping without wiring up a separate metrics
+// surface, which this repo doesn't otherwise have.
+func (tr *mwssTransporter) logMetricsPeriodically() {
+	ticker := time.NewTicker(mwssMetricsLogInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sessionsOpen, reconnects, streamOpenFailures := tr.Metrics()
+		Logger.Infof("[mwss] pool metrics: sessions_open=%d reconnects=%d stream_open_failures=%d",
+			sessionsOpen, reconnects, streamOpenFailures)
+	}
+}
 
-	// 找到可以用的session
-	for sessionIndex, session = range sessions {
-		if session.NumStreams() >= session.maxStreamCnt {
+func (tr *mwssTransporter) Dial(addr string, maxStreamCnt int, tlsConfig *tls.Config, backend MuxBackend) (conn net.Conn, err error) {
+	for {
+		tr.sessionMutex.Lock()
+		var session *muxSession
+		var sessionIndex int
+		sessions, ok := tr.sessions[addr]
+
+		// 找到可以用的session
+		for sessionIndex, session = range sessions {
+			if session.NumStreams() >= session.maxStreamCnt {
+				ok = false
+			} else {
+				ok = true
+				break
+			}
+		}
+
+		// 删除已经关闭的session（正常情况下 watchSession 会更早地摘掉它）
+		if session != nil && session.IsClosed() {
+			Logger.Infof("find closed session %v idx: %d", session, sessionIndex)
+			sessions = append(sessions[:sessionIndex], sessions[sessionIndex+1:]...)
+			tr.sessions[addr] = sessions
 			ok = false
-		} else {
-			ok = true
-			break
 		}
-	}
 
-	// 删除已经关闭的session
-	if session != nil && session.IsClosed() {
-		Logger.Infof("find closed session %v idx: %d", session, sessionIndex)
-		sessions = append(sessions[:sessionIndex], sessions[sessionIndex+1:]...)
-		ok = false
-	}
+		// 复用已有 session 时，开流必须和上面的容量检查在同一个临界区内完成 - 否则两个并发
+		// Dial 都能在释放锁前通过 NumStreams() < maxStreamCnt 的检查，然后同时 GetConn()，
+		// 让这个 session 的流数超过 maxStreamCnt。
+		if ok {
+			cc, err := session.GetConn()
+			tr.sessionMutex.Unlock()
+			if err != nil {
+				atomic.AddInt64(&tr.metrics.streamOpenFailures, 1)
+				session.Close()
+				return nil, err
+			}
+			return cc, nil
+		}
+		tr.sessionMutex.Unlock()
 
-	// 创建新的session
-	if !ok {
-		session, err = tr.initSession(addr)
+		// 创建新的session：并发的 Dial 打到同一个 addr 时，singleflight 保证只有一次真正的重连，
+		// session 的入池也在那一次重连里完成（见 initSessionWithBackoff），这里不用再 append，
+		// 否则等待同一个 singleflight 调用的每个 Dial 都会把同一个 *muxSession 塞进 pool 一次。
+		session, err = tr.getOrInitSession(addr, maxStreamCnt, tlsConfig, backend)
 		if err != nil {
 			return nil, err
 		}
-		sessions = append(sessions, session)
+
+		// getOrInitSession can hand this exact session back to every Dial
+		// that was blocked on the same singleflight call - e.g. a burst of
+		// concurrent Dials racing a reconnect during an outage. Re-check its
+		// capacity under sessionMutex and hold the lock through GetConn,
+		// same as the reuse branch above, instead of opening a stream
+		// unconditionally: otherwise N callers can all pass this point and
+		// push the session's stream count past maxStreamCnt. If it's
+		// already full - another waiter from the same burst claimed the
+		// last slot - loop back: the session is now in the pool, so the
+		// next pass either finds room on it/a sibling or starts another
+		// getOrInitSession round.
+		tr.sessionMutex.Lock()
+		if session.NumStreams() >= session.maxStreamCnt {
+			tr.sessionMutex.Unlock()
+			continue
+		}
+		cc, err := session.GetConn()
+		tr.sessionMutex.Unlock()
+		if err != nil {
+			atomic.AddInt64(&tr.metrics.streamOpenFailures, 1)
+			session.Close()
+			return nil, err
+		}
+		return cc, nil
 	}
-	cc, err := session.GetConn()
+}
+
+// getOrInitSession collapses concurrent reconnects to addr into a single
+// initSessionWithBackoff call via singleflight: every caller waiting on that
+// call gets back the same *muxSession. It does not tell a caller whether it
+// started the reconnect or only received another goroutine's result.
+func (tr *mwssTransporter) getOrInitSession(addr string, maxStreamCnt int, tlsConfig *tls.Config, backend MuxBackend) (*muxSession, error) {
+	v, err, _ := tr.dialGroup.Do(addr, func() (interface{}, error) {
+		return tr.initSessionWithBackoff(addr, maxStreamCnt, tlsConfig, backend)
+	})
 	if err != nil {
-		session.Close()
 		return nil, err
 	}
-	tr.sessions[addr] = sessions
-	return cc, nil
+	return v.(*muxSession), nil
+}
+
+// initSessionWithBackoff retries initSession with exponential backoff and
+// full jitter (100ms -> 5s) up to initSessionMaxRetries times, so a single
+// transient dial error no longer propagates straight up to the caller. It
+// runs inside dialGroup.Do, so singleflight guarantees it executes exactly
+// once per addr no matter how many Dial calls are waiting on it - which is
+// why the successful session is added to the pool right here rather than
+// by every caller that gets the (possibly shared) result back.
+func (tr *mwssTransporter) initSessionWithBackoff(addr string, maxStreamCnt int, tlsConfig *tls.Config, backend MuxBackend) (*muxSession, error) {
+	var lastErr error
+	for attempt := 0; attempt <= initSessionMaxRetries; attempt++ {
+		if attempt > 0 {
+			atomic.AddInt64(&tr.metrics.reconnects, 1)
+			time.Sleep(fullJitterBackoff(attempt - 1))
+		}
+		session, err := tr.initSession(addr, maxStreamCnt, tlsConfig, backend)
+		if err == nil {
+			atomic.AddInt64(&tr.metrics.sessionsOpen, 1)
+			tr.sessionMutex.Lock()
+			tr.sessions[addr] = append(tr.sessions[addr], session)
+			tr.sessionMutex.Unlock()
+			go tr.watchSession(addr, session)
+			return session, nil
+		}
+		lastErr = err
+		Logger.Infof("[mwss] init session to %s failed (attempt %d/%d): %s", addr, attempt+1, initSessionMaxRetries+1, err)
+	}
+	return nil, lastErr
+}
+
+// watchSession removes session from the pool as soon as its underlying
+// mux session closes, instead of waiting for the next Dial to notice via
+// IsClosed().
+func (tr *mwssTransporter) watchSession(addr string, s *muxSession) {
+	<-s.session.CloseChan()
+
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	sessions := tr.sessions[addr]
+	for i, sess := range sessions {
+		if sess == s {
+			tr.sessions[addr] = append(sessions[:i], sessions[i+1:]...)
+			break
+		}
+	}
+	atomic.AddInt64(&tr.metrics.sessionsOpen, -1)
+	Logger.Infof("[mwss] session to %s closed, removed from pool", addr)
 }
 
-func (tr *mwssTransporter) initSession(addr string) (*muxSession, error) {
-	d := ws.Dialer{TLSConfig: DefaultTLSConfig}
+// fullJitterBackoff returns a random duration in [0, min(backoffMax,
+// backoffMin*2^attempt)), per the AWS "full jitter" strategy.
+func fullJitterBackoff(attempt int) time.Duration {
+	max := initSessionBackoffMin << uint(attempt)
+	if max <= 0 || max > initSessionBackoffMax {
+		max = initSessionBackoffMax
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// clampMaxStreamCnt keeps a relay's configured MaxStreamCnt within
+// [MinMWSSStreamCnt, MaxMWSSStreamCntLimit], so a misconfigured value (0,
+// negative, or absurdly large) can't starve a session of its stream cap or
+// let one session hoard an unbounded number of streams.
+func clampMaxStreamCnt(n int) int {
+	if n < MinMWSSStreamCnt {
+		return MinMWSSStreamCnt
+	}
+	if n > MaxMWSSStreamCntLimit {
+		return MaxMWSSStreamCntLimit
+	}
+	return n
+}
+
+func (tr *mwssTransporter) initSession(addr string, maxStreamCnt int, tlsConfig *tls.Config, backend MuxBackend) (*muxSession, error) {
+	if tlsConfig == nil {
+		tlsConfig = DefaultTLSConfig
+	}
+	if maxStreamCnt <= 0 {
+		maxStreamCnt = MaxMWSSStreamCnt
+	}
+	maxStreamCnt = clampMaxStreamCnt(maxStreamCnt)
+	if backend == nil {
+		backend = muxBackendByName(defaultMuxBackend)
+	}
+	d := ws.Dialer{TLSConfig: tlsConfig}
 	rc, _, _, err := d.Dial(context.TODO(), addr)
 	if err != nil {
 		return nil, err
@@ -74,14 +268,17 @@ func (tr *mwssTransporter) initSession(addr string) (*muxSession, error) {
 	wsc := NewDeadLinerConn(rc, WsDeadline)
 
 	// stream multiplex
-	smuxConfig := smux.DefaultConfig()
-	session, err := smux.Client(wsc, smuxConfig)
+	session, err := backend.ClientSession(wsc, MuxConfig{
+		MaxStreamCnt:      maxStreamCnt,
+		KeepAliveInterval: mwssKeepAliveInterval,
+		KeepAliveTimeout:  mwssKeepAliveTimeout,
+	})
 	if err != nil {
 		return nil, err
 	}
-	Logger.Infof("[mwss] Init new session %s", session.RemoteAddr())
+	Logger.Infof("[mwss] Init new %s session to %s", backend.Name(), addr)
 	return &muxSession{
-		conn: wsc, session: session, maxStreamCnt: MaxMWSSStreamCnt, t: WsDeadline}, nil
+		conn: wsc, session: session, maxStreamCnt: maxStreamCnt, t: WsDeadline}, nil
 }
 
 func (r *Relay) RunLocalMWSSServer() error {
@@ -92,14 +289,46 @@ func (r *Relay) RunLocalMWSSServer() error {
 		errChan:  make(chan error, 1),
 	}
 
+	wssPath := r.WSSPath
+	if wssPath == "" {
+		wssPath = DefaultMWSSPath
+	}
+	tlsConfig := r.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = DefaultTLSConfig
+	}
+
+	udpPath := r.UDPPath
+	if udpPath == "" {
+		udpPath = DefaultMWSSUDPPath
+	}
+
 	mux := http.NewServeMux()
-	mux.Handle("/tcp/", http.HandlerFunc(s.upgrade))
+	// Plain "/tcp/" and "/udp/" keep working for older clients that never
+	// send a mux sub-path; they're routed to the default (smux) backend.
+	mux.Handle(wssPath, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.upgrade(w, req, muxBackendByName(defaultMuxBackend))
+	}))
+	mux.Handle(udpPath, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.upgradeUDP(w, req, r.RemoteTCPAddr, muxBackendByName(defaultMuxBackend))
+	}))
+	// "/tcp/<backend>/" and "/udp/<backend>/" let one server terminate
+	// clients that each picked a different mux backend.
+	for name, backend := range muxBackends {
+		backend := backend
+		mux.Handle(wssPath+name+"/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.upgrade(w, req, backend)
+		}))
+		mux.Handle(udpPath+name+"/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.upgradeUDP(w, req, r.RemoteTCPAddr, backend)
+		}))
+	}
 	// fake
 	mux.Handle("/", http.HandlerFunc(index))
 	server := &http.Server{
 		Addr:              r.LocalTCPAddr.String(),
 		Handler:           mux,
-		TLSConfig:         DefaultTLSConfig,
+		TLSConfig:         tlsConfig,
 		ReadHeaderTimeout: 30 * time.Second,
 	}
 	s.server = server
@@ -148,42 +377,124 @@ type MWSSServer struct {
 	errChan  chan error
 }
 
-func (s *MWSSServer) upgrade(w http.ResponseWriter, r *http.Request) {
+func (s *MWSSServer) upgrade(w http.ResponseWriter, r *http.Request, backend MuxBackend) {
 	conn, _, _, err := ws.UpgradeHTTP(r, w)
 	if err != nil {
 		Logger.Info(err)
 		return
 	}
-	s.mux(NewDeadLinerConn(conn, WsDeadline))
+	s.mux(NewDeadLinerConn(conn, WsDeadline), backend)
 }
 
-func (s *MWSSServer) mux(conn net.Conn) {
-	smuxConfig := smux.DefaultConfig()
-	mux, err := smux.Server(conn, smuxConfig)
+func (s *MWSSServer) upgradeUDP(w http.ResponseWriter, r *http.Request, remoteUDPAddr string, backend MuxBackend) {
+	conn, _, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		Logger.Info(err)
+		return
+	}
+	s.muxUDP(NewDeadLinerConn(conn, WsDeadline), remoteUDPAddr, backend)
+}
+
+// muxUDP accepts streams off backend's session the same way mux does for
+// TCP, but every stream gets its own UDP association against
+// remoteUDPAddr instead of being queued through connChan.
+func (s *MWSSServer) muxUDP(conn net.Conn, remoteUDPAddr string, backend MuxBackend) {
+	session, err := backend.ServerSession(conn, MuxConfig{
+		KeepAliveInterval: mwssKeepAliveInterval,
+		KeepAliveTimeout:  mwssKeepAliveTimeout,
+	})
+	if err != nil {
+		Logger.Infof("[mwss-udp] %s - %s : %s", conn.RemoteAddr(), s.Addr(), err)
+		return
+	}
+	defer session.Close()
+
+	Logger.Infof("[mwss-udp] %s <-> %s (%s)", conn.RemoteAddr(), s.Addr(), backend.Name())
+	defer Logger.Infof("[mwss-udp] %s >-< %s", conn.RemoteAddr(), s.Addr())
+
+	failedCount := 0
+	for failedCount < 5 {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			Logger.Infof("[mwss-udp] accept stream err: %s failedCount: %d", err, failedCount)
+			failedCount++
+			break
+		}
+		cc := NewDeadLinerConn(stream, WsDeadline)
+		go handleMWSSStreamToUdp(cc, remoteUDPAddr)
+	}
+}
+
+func (s *MWSSServer) mux(conn net.Conn, backend MuxBackend) {
+	session, err := backend.ServerSession(conn, MuxConfig{
+		KeepAliveInterval: mwssKeepAliveInterval,
+		KeepAliveTimeout:  mwssKeepAliveTimeout,
+	})
 	if err != nil {
 		Logger.Infof("[mwss] %s - %s : %s", conn.RemoteAddr(), s.Addr(), err)
 		return
 	}
-	defer mux.Close()
+	defer session.Close()
 
-	Logger.Infof("[mwss] %s <-> %s", conn.RemoteAddr(), s.Addr())
+	Logger.Infof("[mwss] %s <-> %s (%s)", conn.RemoteAddr(), s.Addr(), backend.Name())
 	defer Logger.Infof("[mwss] %s >-< %s", conn.RemoteAddr(), s.Addr())
 
 	failedCount := 0
 	for failedCount < 5 {
-		stream, err := mux.AcceptStream()
+		stream, err := session.AcceptStream()
 		if err != nil {
 			Logger.Infof("[mwss] accept stream err: %s failedCount: %d", err, failedCount)
 			failedCount++
 			break
 		}
-		cc := newMuxDeadlineStreamConn(conn, stream, WsDeadline)
+		cc := NewDeadLinerConn(stream, WsDeadline)
+		go s.routeResumableStream(cc)
+	}
+}
+
+// routeResumableStream reads the small handshake frame every resumable
+// stream opens with and either starts a brand new logical stream or
+// reattaches the smux stream to an existing one, so a reconnect doesn't
+// have to restart handleMWSSConnToTcp or lose in-flight bytes.
+func (s *MWSSServer) routeResumableStream(cc net.Conn) {
+	kind, id, rxSeq, err := readHandshake(cc)
+	if err != nil {
+		Logger.Infof("[mwss] handshake read error: %s", err)
+		cc.Close()
+		return
+	}
+
+	switch kind {
+	case frameKindNew:
+		assoc := mwssAssocs.create(id)
+		assoc.attach(cc, 0)
 		select {
-		case s.connChan <- cc:
+		case s.connChan <- assoc:
 		default:
+			assoc.Close()
+			Logger.Infof("[mwss] %s: connection queue is full", cc.RemoteAddr())
+		}
+	case frameKindResume:
+		assoc, ok := mwssAssocs.get(id)
+		if !ok {
+			Logger.Infof("[mwss] resume for unknown or expired stream %s", id)
+			cc.Close()
+			return
+		}
+		// The ack must precede any replay payload attach may write onto cc,
+		// or the client's handshake reader can't tell the two apart.
+		if err := writeResumeAck(cc, assoc.rxSeqSnapshot()); err != nil {
+			Logger.Infof("[mwss] resume ack failed for %s: %s", id, err)
+			cc.Close()
+			return
+		}
+		if err := assoc.attach(cc, rxSeq); err != nil {
+			Logger.Infof("[mwss] resume replay failed for %s: %s", id, err)
 			cc.Close()
-			Logger.Infof("[mwss] %s - %s: connection queue is full", conn.RemoteAddr(), conn.LocalAddr())
 		}
+	default:
+		Logger.Infof("[mwss] unknown handshake frame kind %d", kind)
+		cc.Close()
 	}
 }
 
@@ -205,18 +516,46 @@ func (s *MWSSServer) Addr() string {
 
 var tr = NewMWSSTransporter()
 
+// muxQuery renders the relay's configured Mux backend (smux/yamux/h2) as
+// the "?mux=" query string muxBackendFromRemote expects, or "" to fall
+// back to the default backend.
+func (r *Relay) muxQuery() string {
+	if r.Mux == "" {
+		return ""
+	}
+	return "?mux=" + r.Mux
+}
+
 func (r *Relay) handleTcpOverMWSS(c *net.TCPConn) error {
 	dc := NewDeadLinerConn(c, TcpDeadline)
 	defer dc.Close()
 
-	addr := r.RemoteTCPAddr + "/tcp/"
-	wsc, err := tr.Dial(addr)
+	wssPath := r.WSSPath
+	if wssPath == "" {
+		wssPath = DefaultMWSSPath
+	}
+	backend, addr := muxBackendFromRemote(r.RemoteTCPAddr + wssPath + r.muxQuery())
+	wsc, err := tr.Dial(addr, r.MaxStreamCnt, r.TLSConfig, backend)
 	if err != nil {
 		return err
 	}
-	defer wsc.Close()
-	Logger.Infof("handleTcpOverMWSS from:%s to:%s", c.RemoteAddr(), wsc.RemoteAddr())
-	transport(wsc, dc)
+
+	id, err := newGlobalID()
+	if err != nil {
+		wsc.Close()
+		return err
+	}
+	if err := writeHandshake(wsc, frameKindNew, id, 0); err != nil {
+		wsc.Close()
+		return err
+	}
+	rc := newResumableConn(wsc, id, func() (net.Conn, error) {
+		return tr.Dial(addr, r.MaxStreamCnt, r.TLSConfig, backend)
+	})
+	defer rc.Close()
+
+	Logger.Infof("handleTcpOverMWSS from:%s to:%s id:%s", c.RemoteAddr(), wsc.RemoteAddr(), id)
+	transport(rc, dc)
 	return nil
 }
 
@@ -232,4 +571,4 @@ func (r *Relay) handleMWSSConnToTcp(c net.Conn) {
 
 	Logger.Infof("handleMWSSConnToTcp from:%s to:%s", c.RemoteAddr(), rc.RemoteAddr())
 	transport(drc, c)
-}
\ No newline at end of file
+}
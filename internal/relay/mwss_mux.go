@@ -0,0 +1,555 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/xtaci/smux"
+	"golang.org/x/net/http2"
+)
+
+// MuxConfig carries the knobs handed to every MuxBackend implementation,
+// so callers don't need to know which concrete backend is in play. The
+// backends read only KeepAliveInterval and KeepAliveTimeout; none of them
+// enforces MaxStreamCnt, which mwssTransporter applies per session through
+// muxSession.maxStreamCnt.
+type MuxConfig struct {
+	MaxStreamCnt      int
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+}
+
+// MuxSession is the surface mwssTransporter and MWSSServer need from a
+// multiplexed connection, regardless of which wire protocol implements it.
+type MuxSession interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	Close() error
+	IsClosed() bool
+	NumStreams() int
+	CloseChan() <-chan struct{}
+}
+
+// MuxBackend negotiates a MuxSession over an already-established
+// connection, client or server side.
+type MuxBackend interface {
+	Name() string
+	ClientSession(conn net.Conn, cfg MuxConfig) (MuxSession, error)
+	ServerSession(conn net.Conn, cfg MuxConfig) (MuxSession, error)
+}
+
+const defaultMuxBackend = "smux"
+
+var muxBackends = map[string]MuxBackend{
+	"smux":  smuxBackend{},
+	"yamux": yamuxBackend{},
+	"h2":    h2Backend{},
+}
+
+func muxBackendByName(name string) MuxBackend {
+	if b, ok := muxBackends[name]; ok {
+		return b
+	}
+	return muxBackends[defaultMuxBackend]
+}
+
+// muxBackendFromRemote reads the `mux` query param off a relay's configured
+// remote (e.g. "wss://host/tcp/?mux=yamux"), returning the backend it
+// selects and the dial URL rewritten as "wss://host/tcp/yamux/" so the
+// server's path-prefix routing agrees with the client's own choice.
+func muxBackendFromRemote(remote string) (MuxBackend, string) {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return muxBackendByName(defaultMuxBackend), remote
+	}
+	name := u.Query().Get("mux")
+	if name == "" {
+		return muxBackendByName(defaultMuxBackend), remote
+	}
+	backend := muxBackendByName(name)
+	u.RawQuery = ""
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	// The path must name whichever backend we actually selected, not the
+	// raw (possibly unrecognized) "mux=" value: muxBackendByName already
+	// falls back to smux for an unknown name, and RunLocalMWSSServer only
+	// registers paths for the real backend names, so a literal unrecognized
+	// name here would dial a path the server never handles.
+	u.Path += backend.Name() + "/"
+	return backend, u.String()
+}
+
+// --- smux backend: the original behavior, just behind the interface ---
+
+type smuxSessionAdapter struct{ s *smux.Session }
+
+func (a smuxSessionAdapter) OpenStream() (net.Conn, error)   { return a.s.OpenStream() }
+func (a smuxSessionAdapter) AcceptStream() (net.Conn, error) { return a.s.AcceptStream() }
+func (a smuxSessionAdapter) Close() error                    { return a.s.Close() }
+func (a smuxSessionAdapter) IsClosed() bool                  { return a.s.IsClosed() }
+func (a smuxSessionAdapter) NumStreams() int                 { return a.s.NumStreams() }
+func (a smuxSessionAdapter) CloseChan() <-chan struct{}      { return a.s.CloseChan() }
+
+type smuxBackend struct{}
+
+func (smuxBackend) Name() string { return "smux" }
+
+func (smuxBackend) ClientSession(conn net.Conn, cfg MuxConfig) (MuxSession, error) {
+	c := smux.DefaultConfig()
+	c.KeepAliveInterval = cfg.KeepAliveInterval
+	c.KeepAliveTimeout = cfg.KeepAliveTimeout
+	s, err := smux.Client(conn, c)
+	if err != nil {
+		return nil, err
+	}
+	return smuxSessionAdapter{s}, nil
+}
+
+func (smuxBackend) ServerSession(conn net.Conn, cfg MuxConfig) (MuxSession, error) {
+	c := smux.DefaultConfig()
+	c.KeepAliveInterval = cfg.KeepAliveInterval
+	c.KeepAliveTimeout = cfg.KeepAliveTimeout
+	s, err := smux.Server(conn, c)
+	if err != nil {
+		return nil, err
+	}
+	return smuxSessionAdapter{s}, nil
+}
+
+// --- yamux backend ---
+
+type yamuxSessionAdapter struct{ s *yamux.Session }
+
+func (a yamuxSessionAdapter) OpenStream() (net.Conn, error)   { return a.s.OpenStream() }
+func (a yamuxSessionAdapter) AcceptStream() (net.Conn, error) { return a.s.AcceptStream() }
+func (a yamuxSessionAdapter) Close() error                    { return a.s.Close() }
+func (a yamuxSessionAdapter) NumStreams() int                 { return a.s.NumStreams() }
+func (a yamuxSessionAdapter) CloseChan() <-chan struct{}      { return a.s.CloseChan() }
+
+func (a yamuxSessionAdapter) IsClosed() bool {
+	select {
+	case <-a.s.CloseChan():
+		return true
+	default:
+		return false
+	}
+}
+
+type yamuxBackend struct{}
+
+func (yamuxBackend) Name() string { return "yamux" }
+
+func yamuxConfig(cfg MuxConfig) *yamux.Config {
+	c := yamux.DefaultConfig()
+	if cfg.KeepAliveInterval > 0 {
+		c.EnableKeepAlive = true
+		c.KeepAliveInterval = cfg.KeepAliveInterval
+	}
+	if cfg.KeepAliveTimeout > 0 {
+		c.ConnectionWriteTimeout = cfg.KeepAliveTimeout
+	}
+	return c
+}
+
+func (yamuxBackend) ClientSession(conn net.Conn, cfg MuxConfig) (MuxSession, error) {
+	s, err := yamux.Client(conn, yamuxConfig(cfg))
+	if err != nil {
+		return nil, err
+	}
+	return yamuxSessionAdapter{s}, nil
+}
+
+func (yamuxBackend) ServerSession(conn net.Conn, cfg MuxConfig) (MuxSession, error) {
+	s, err := yamux.Server(conn, yamuxConfig(cfg))
+	if err != nil {
+		return nil, err
+	}
+	return yamuxSessionAdapter{s}, nil
+}
+
+// --- h2 backend ---
+//
+// h2Session is a minimal stream multiplexer built on the wire format of
+// HTTP/2's framing layer (preface, SETTINGS, HEADERS, DATA), so the tunnel
+// looks like ordinary HTTP/2 traffic to CDNs/proxies that only forward
+// that and not raw WebSocket framing over smux/yamux. It does not speak
+// full RFC 7540 HTTP semantics (no HPACK header contents, no flow
+// control) since both ends are always us - the tunnel carries raw bytes,
+// not HTTP requests.
+
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// h2Stream queues incoming DATA frame payloads and hands them to its own
+// pump goroutine rather than writing straight into rd/wr from
+// h2Session.readLoop - a slow reader on one stream must never stall the
+// single dispatch goroutine every other stream on the session depends on.
+type h2Stream struct {
+	id   uint32
+	sess *h2Session
+	rd   *io.PipeReader
+	wr   *io.PipeWriter
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue [][]byte
+	ended bool
+}
+
+func (st *h2Stream) Read(p []byte) (int, error) { return st.rd.Read(p) }
+
+func (st *h2Stream) Write(p []byte) (int, error) {
+	st.sess.writeMu.Lock()
+	defer st.sess.writeMu.Unlock()
+	if err := st.sess.framer.WriteData(st.id, false, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// enqueue copies data (the framer reuses its read buffer across frames) and
+// hands it to pump, returning immediately so readLoop never blocks here.
+func (st *h2Stream) enqueue(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	st.mu.Lock()
+	st.queue = append(st.queue, buf)
+	st.mu.Unlock()
+	st.cond.Signal()
+}
+
+// end marks the stream as having no more data coming, letting pump drain
+// whatever is left in queue and exit instead of waiting forever.
+func (st *h2Stream) end() {
+	st.mu.Lock()
+	st.ended = true
+	st.mu.Unlock()
+	st.cond.Signal()
+}
+
+// abort unblocks a pending Read with err and stops pump immediately,
+// discarding anything still queued - used when the stream is reset.
+func (st *h2Stream) abort(err error) {
+	st.wr.CloseWithError(err)
+	st.end()
+}
+
+// pump is the only goroutine that writes into wr, so a stream whose reader
+// is slow (or stalled) only blocks its own pump, never h2Session.readLoop.
+func (st *h2Stream) pump() {
+	for {
+		st.mu.Lock()
+		for len(st.queue) == 0 && !st.ended {
+			st.cond.Wait()
+		}
+		if len(st.queue) == 0 {
+			st.mu.Unlock()
+			st.wr.Close()
+			return
+		}
+		data := st.queue[0]
+		st.queue = st.queue[1:]
+		st.mu.Unlock()
+
+		if _, err := st.wr.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+func (st *h2Stream) Close() error {
+	st.sess.mu.Lock()
+	delete(st.sess.streams, st.id)
+	st.sess.mu.Unlock()
+
+	st.sess.writeMu.Lock()
+	st.sess.framer.WriteData(st.id, true, nil)
+	st.sess.writeMu.Unlock()
+	st.end()
+	return nil
+}
+
+func (st *h2Stream) LocalAddr() net.Addr                { return st.sess.conn.LocalAddr() }
+func (st *h2Stream) RemoteAddr() net.Addr               { return st.sess.conn.RemoteAddr() }
+func (st *h2Stream) SetDeadline(t time.Time) error      { return st.sess.conn.SetDeadline(t) }
+func (st *h2Stream) SetReadDeadline(t time.Time) error  { return st.sess.conn.SetReadDeadline(t) }
+func (st *h2Stream) SetWriteDeadline(t time.Time) error { return st.sess.conn.SetWriteDeadline(t) }
+
+type h2Session struct {
+	conn   net.Conn
+	framer *http2.Framer
+
+	mu      sync.Mutex
+	nextID  uint32
+	streams map[uint32]*h2Stream
+
+	writeMu   sync.Mutex
+	accept    chan *h2Stream
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	pingMu   sync.Mutex
+	lastPong time.Time
+}
+
+func newH2Session(conn net.Conn, isClient bool, cfg MuxConfig) (*h2Session, error) {
+	if isClient {
+		if _, err := conn.Write([]byte(h2Preface)); err != nil {
+			return nil, err
+		}
+	} else {
+		buf := make([]byte, len(h2Preface))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		if string(buf) != h2Preface {
+			return nil, errors.New("mux/h2: bad client preface")
+		}
+	}
+
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		return nil, err
+	}
+	f, err := framer.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(*http2.SettingsFrame); !ok {
+		return nil, fmt.Errorf("mux/h2: expected initial SETTINGS frame, got %T", f)
+	}
+	if err := framer.WriteSettingsAck(); err != nil {
+		return nil, err
+	}
+
+	s := &h2Session{
+		conn:     conn,
+		framer:   framer,
+		streams:  make(map[uint32]*h2Stream),
+		accept:   make(chan *h2Stream, 64),
+		closeCh:  make(chan struct{}),
+		lastPong: time.Now(),
+	}
+	if isClient {
+		s.nextID = 1
+	} else {
+		s.nextID = 2
+	}
+	go s.readLoop()
+	if cfg.KeepAliveInterval > 0 {
+		go s.keepalive(cfg.KeepAliveInterval, cfg.KeepAliveTimeout)
+	}
+	return s, nil
+}
+
+func (s *h2Session) newStreamLocked(id uint32) *h2Stream {
+	pr, pw := io.Pipe()
+	st := &h2Stream{id: id, sess: s, rd: pr, wr: pw}
+	st.cond = sync.NewCond(&st.mu)
+	s.streams[id] = st
+	go st.pump()
+	return st
+}
+
+// keepalive pings the peer every interval and closes the session if no
+// PING ack has come back within timeout, the same liveness contract smux
+// and yamux give callers via MuxConfig.
+func (s *h2Session) keepalive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+		}
+		if timeout > 0 {
+			s.pingMu.Lock()
+			stale := time.Since(s.lastPong) > timeout
+			s.pingMu.Unlock()
+			if stale {
+				Logger.Infof("[mux/h2] keepalive timeout waiting for PING ack, closing session")
+				s.Close()
+				return
+			}
+		}
+		s.writeMu.Lock()
+		err := s.framer.WritePing(false, [8]byte{})
+		s.writeMu.Unlock()
+		if err != nil {
+			Logger.Infof("[mux/h2] keepalive ping failed: %s", err)
+			s.Close()
+			return
+		}
+	}
+}
+
+func (s *h2Session) OpenStream() (net.Conn, error) {
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID += 2
+	st := s.newStreamLocked(id)
+	s.mu.Unlock()
+
+	s.writeMu.Lock()
+	err := s.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: id, EndHeaders: true})
+	s.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *h2Session) AcceptStream() (net.Conn, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closeCh:
+		return nil, errors.New("mux/h2: session closed")
+	}
+}
+
+func (s *h2Session) readLoop() {
+	defer s.Close()
+	for {
+		f, err := s.framer.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch fr := f.(type) {
+		case *http2.HeadersFrame:
+			s.mu.Lock()
+			_, exists := s.streams[fr.StreamID]
+			var st *h2Stream
+			if !exists {
+				st = s.newStreamLocked(fr.StreamID)
+			}
+			s.mu.Unlock()
+			if !exists {
+				select {
+				case s.accept <- st:
+				default:
+					st.Close()
+				}
+			}
+		case *http2.DataFrame:
+			s.mu.Lock()
+			st, exists := s.streams[fr.StreamID]
+			s.mu.Unlock()
+			if !exists {
+				continue
+			}
+			st.enqueue(fr.Data())
+			if fr.StreamEnded() {
+				st.end()
+			}
+		case *http2.RSTStreamFrame:
+			s.mu.Lock()
+			st, exists := s.streams[fr.StreamID]
+			delete(s.streams, fr.StreamID)
+			s.mu.Unlock()
+			if exists {
+				st.abort(io.ErrClosedPipe)
+			}
+		case *http2.SettingsFrame:
+			if !fr.IsAck() {
+				s.writeMu.Lock()
+				s.framer.WriteSettingsAck()
+				s.writeMu.Unlock()
+			}
+		case *http2.PingFrame:
+			if fr.IsAck() {
+				s.pingMu.Lock()
+				s.lastPong = time.Now()
+				s.pingMu.Unlock()
+			} else {
+				s.writeMu.Lock()
+				s.framer.WritePing(true, fr.Data)
+				s.writeMu.Unlock()
+			}
+		}
+	}
+}
+
+func (s *h2Session) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*h2Stream)
+		s.mu.Unlock()
+		// Unlike smux/yamux, which tear down every open stream on Close,
+		// h2Stream.Read blocks on an io.PipeReader and pump() blocks on
+		// st.cond - neither notices the session dying on its own. Without
+		// this, a consumer blocked in Read hangs forever instead of seeing
+		// an error, which also means ResumableConn/serverAssoc never see
+		// the Read/Write failure they rely on to trigger reconnect/resume.
+		for _, st := range streams {
+			st.abort(io.ErrClosedPipe)
+		}
+	})
+	return s.conn.Close()
+}
+
+func (s *h2Session) IsClosed() bool {
+	select {
+	case <-s.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *h2Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *h2Session) CloseChan() <-chan struct{} { return s.closeCh }
+
+type h2Backend struct{}
+
+func (h2Backend) Name() string { return "h2" }
+
+func (h2Backend) ClientSession(conn net.Conn, cfg MuxConfig) (MuxSession, error) {
+	return newH2Session(conn, true, cfg)
+}
+
+func (h2Backend) ServerSession(conn net.Conn, cfg MuxConfig) (MuxSession, error) {
+	return newH2Session(conn, false, cfg)
+}
+
+// muxSession pairs a negotiated MuxSession with the deadline-wrapping conn
+// it was negotiated over and the per-relay limits that created it. It is
+// the common type mwssTransporter pools, regardless of backend.
+type muxSession struct {
+	conn         net.Conn
+	session      MuxSession
+	maxStreamCnt int
+	t            time.Duration
+}
+
+func (m *muxSession) NumStreams() int { return m.session.NumStreams() }
+func (m *muxSession) IsClosed() bool  { return m.session.IsClosed() }
+func (m *muxSession) Close() error    { return m.session.Close() }
+
+// GetConn opens a new stream and wraps it with the session's read/write
+// deadline, the same treatment a freshly accepted server-side stream gets.
+func (m *muxSession) GetConn() (net.Conn, error) {
+	stream, err := m.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return NewDeadLinerConn(stream, m.t), nil
+}
@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpLoopback returns a connected client/server net.Conn pair over real TCP
+// loopback, unlike net.Pipe() which is fully synchronous/unbuffered: two
+// h2Sessions handshaking (each writing its own SETTINGS frame before
+// reading the peer's) would deadlock on net.Pipe, since both sides' writes
+// block waiting for a reader that is itself blocked writing. A real TCP
+// conn has OS-level send buffering, the same as the MWSS-over-WebSocket
+// conns h2Session actually runs over in production.
+func tcpLoopback(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer ln.Close()
+
+	acceptCh := make(chan net.Conn, 1)
+	acceptErrCh := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			acceptErrCh <- err
+			return
+		}
+		acceptCh <- c
+	}()
+
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	select {
+	case server = <-acceptCh:
+	case err := <-acceptErrCh:
+		t.Fatalf("Accept: %v", err)
+	}
+	return client, server
+}
+
+// TestH2SessionCloseAbortsOpenStreams guards against h2Session.Close only
+// tearing down closeCh and the raw conn: a stream's Read blocks on an
+// io.PipeReader that nothing else notices the session dying, so without
+// aborting every open stream on Close, a consumer blocked in Read hangs
+// forever instead of seeing an error.
+func TestH2SessionCloseAbortsOpenStreams(t *testing.T) {
+	clientConn, serverConn := tcpLoopback(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	type result struct {
+		sess *h2Session
+		err  error
+	}
+	clientCh := make(chan result, 1)
+	serverCh := make(chan result, 1)
+	go func() {
+		s, err := newH2Session(clientConn, true, MuxConfig{})
+		clientCh <- result{s, err}
+	}()
+	go func() {
+		s, err := newH2Session(serverConn, false, MuxConfig{})
+		serverCh <- result{s, err}
+	}()
+
+	const handshakeTimeout = 5 * time.Second
+	var clientRes, serverRes result
+	select {
+	case clientRes = <-clientCh:
+	case <-time.After(handshakeTimeout):
+		t.Fatal("client newH2Session did not complete in time")
+	}
+	if clientRes.err != nil {
+		t.Fatalf("client newH2Session: %v", clientRes.err)
+	}
+	defer clientRes.sess.Close()
+	select {
+	case serverRes = <-serverCh:
+	case <-time.After(handshakeTimeout):
+		t.Fatal("server newH2Session did not complete in time")
+	}
+	if serverRes.err != nil {
+		t.Fatalf("server newH2Session: %v", serverRes.err)
+	}
+
+	if _, err := clientRes.sess.OpenStream(); err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+
+	st, err := serverRes.sess.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+
+	if err := serverRes.sess.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	readErrCh := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		readErrCh <- err
+	}()
+
+	select {
+	case err := <-readErrCh:
+		if err == nil {
+			t.Fatal("Read on a stream belonging to a closed session succeeded, want error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Read on a stream belonging to a closed session hung instead of erroring")
+	}
+}
@@ -0,0 +1,501 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	globalIDSize = 16
+
+	// resumableBufSize is the size of the in-memory ring buffer each side
+	// keeps of unacknowledged bytes, so a brief reconnect can replay
+	// whatever the peer missed instead of losing it.
+	resumableBufSize = 256 * 1024
+
+	// resumeAssocTTL is how long a server-side association is kept around
+	// waiting for a RESUME after its stream breaks, before being GC'd.
+	resumeAssocTTL = 30 * time.Second
+
+	frameKindNew    byte = 1
+	frameKindResume byte = 2
+)
+
+// GlobalID identifies one logical stream across reconnects, independent of
+// which smux session/stream currently carries its bytes.
+type GlobalID [globalIDSize]byte
+
+func newGlobalID() (GlobalID, error) {
+	var id GlobalID
+	_, err := io.ReadFull(rand.Reader, id[:])
+	return id, err
+}
+
+func (id GlobalID) String() string {
+	return fmt.Sprintf("%x", id[:])
+}
+
+// writeHandshake sends the small framing header a freshly opened stream
+// leads with: either "this is a brand new logical stream" or "resume
+// logical stream id from byte rxSeq".
+func writeHandshake(w io.Writer, kind byte, id GlobalID, rxSeq uint64) error {
+	buf := make([]byte, 1+globalIDSize+8)
+	buf[0] = kind
+	copy(buf[1:], id[:])
+	binary.BigEndian.PutUint64(buf[1+globalIDSize:], rxSeq)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readHandshake(r io.Reader) (kind byte, id GlobalID, rxSeq uint64, err error) {
+	buf := make([]byte, 1+globalIDSize+8)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return
+	}
+	kind = buf[0]
+	copy(id[:], buf[1:1+globalIDSize])
+	rxSeq = binary.BigEndian.Uint64(buf[1+globalIDSize:])
+	return
+}
+
+// writeResumeAck replies to a RESUME with the association's own rxSeq, the
+// counterpart of the rxSeq a RESUME carries: it tells the resuming side
+// exactly how much of what it previously sent was received, so it can
+// replay anything still unacknowledged from its own send-side ring buffer.
+// Without this, only the server->client direction of a reconnect replays;
+// bytes the client wrote just before the break are silently lost.
+func writeResumeAck(w io.Writer, rxSeq uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, rxSeq)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readResumeAck(r io.Reader) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+// ringBuffer keeps the last resumableBufSize bytes written, tagged with the
+// absolute sequence number of its first byte, so a resumed stream can ask
+// to replay from any point still inside the window.
+type ringBuffer struct {
+	mu       sync.Mutex
+	buf      []byte
+	startSeq uint64 // absolute sequence number of buf[0]
+	endSeq   uint64 // absolute sequence number of the next byte to be written
+}
+
+func (b *ringBuffer) Write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	b.endSeq += uint64(len(p))
+	if len(b.buf) > resumableBufSize {
+		drop := len(b.buf) - resumableBufSize
+		b.buf = b.buf[drop:]
+		b.startSeq += uint64(drop)
+	}
+}
+
+// Since returns every buffered byte with absolute sequence number >= seq.
+func (b *ringBuffer) Since(seq uint64) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seq < b.startSeq {
+		return nil, fmt.Errorf("resumable: requested seq %d is older than buffered window starting at %d", seq, b.startSeq)
+	}
+	if seq > b.endSeq {
+		return nil, fmt.Errorf("resumable: requested seq %d is ahead of written seq %d", seq, b.endSeq)
+	}
+	off := seq - b.startSeq
+	out := make([]byte, len(b.buf)-int(off))
+	copy(out, b.buf[off:])
+	return out, nil
+}
+
+func (b *ringBuffer) EndSeq() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.endSeq
+}
+
+// redialFunc opens a brand new underlying stream to the same remote
+// endpoint, used to replace a ResumableConn's transport once it breaks.
+type redialFunc func() (net.Conn, error)
+
+// ResumableConn is the client side of a resumable logical stream: it wraps
+// a smux stream with a stable GlobalID and a send-side ring buffer, so a
+// brief WSS/smux reconnect can resume the stream instead of killing it.
+type ResumableConn struct {
+	id     GlobalID
+	redial redialFunc
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	conn         net.Conn
+	txBuf        *ringBuffer
+	rxSeq        uint64
+	closed       bool
+	reconnecting bool
+}
+
+func newResumableConn(conn net.Conn, id GlobalID, redial redialFunc) *ResumableConn {
+	c := &ResumableConn{id: id, redial: redial, conn: conn, txBuf: &ringBuffer{}}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *ResumableConn) Write(p []byte) (int, error) {
+	total := 0
+	for total < len(p) {
+		c.mu.Lock()
+		conn, closed := c.conn, c.closed
+		c.mu.Unlock()
+		if closed {
+			return total, net.ErrClosed
+		}
+
+		n, err := conn.Write(p[total:])
+		if n > 0 {
+			c.txBuf.Write(p[total : total+n])
+			total += n
+		}
+		if err == nil {
+			continue
+		}
+		if rerr := c.reconnect(); rerr != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (c *ResumableConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		conn, closed := c.conn, c.closed
+		c.mu.Unlock()
+		if closed {
+			return 0, net.ErrClosed
+		}
+
+		n, err := conn.Read(p)
+		if n > 0 {
+			c.mu.Lock()
+			c.rxSeq += uint64(n)
+			c.mu.Unlock()
+			return n, nil
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		if rerr := c.reconnect(); rerr != nil {
+			return 0, err
+		}
+	}
+}
+
+// reconnect redials the remote endpoint, sends a RESUME handshake carrying
+// the last byte index this side has consumed, and swaps it in as the
+// conn's active transport. Read and Write can both hit a broken conn and
+// call this concurrently; only the first one actually redials, the rest
+// wait for it and then reuse whatever conn it installed.
+func (c *ResumableConn) reconnect() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	if c.reconnecting {
+		for c.reconnecting && !c.closed {
+			c.cond.Wait()
+		}
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return net.ErrClosed
+		}
+		return nil
+	}
+	c.reconnecting = true
+	old, rxSeq := c.conn, c.rxSeq
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.reconnecting = false
+		c.mu.Unlock()
+		c.cond.Broadcast()
+	}()
+
+	old.Close()
+
+	newConn, err := c.redial()
+	if err != nil {
+		return err
+	}
+	if err := writeHandshake(newConn, frameKindResume, c.id, rxSeq); err != nil {
+		newConn.Close()
+		return err
+	}
+	serverRxSeq, err := readResumeAck(newConn)
+	if err != nil {
+		newConn.Close()
+		return err
+	}
+	if pending, perr := c.txBuf.Since(serverRxSeq); perr == nil && len(pending) > 0 {
+		if _, err := newConn.Write(pending); err != nil {
+			newConn.Close()
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.conn = newConn
+	c.mu.Unlock()
+	Logger.Infof("[mwss] resumed stream %s at rx_seq=%d, replayed from server_rx_seq=%d", c.id, rxSeq, serverRxSeq)
+	return nil
+}
+
+func (c *ResumableConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	return conn.Close()
+}
+
+func (c *ResumableConn) LocalAddr() net.Addr  { return c.peekConn().LocalAddr() }
+func (c *ResumableConn) RemoteAddr() net.Addr { return c.peekConn().RemoteAddr() }
+
+func (c *ResumableConn) SetDeadline(t time.Time) error      { return c.peekConn().SetDeadline(t) }
+func (c *ResumableConn) SetReadDeadline(t time.Time) error  { return c.peekConn().SetReadDeadline(t) }
+func (c *ResumableConn) SetWriteDeadline(t time.Time) error { return c.peekConn().SetWriteDeadline(t) }
+
+func (c *ResumableConn) peekConn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// serverAssoc is the server side of a resumable logical stream: one
+// backend TCP connection dialed on first sight of a GlobalID, whose
+// WSS-facing side can be swapped out across reconnects without restarting
+// handleMWSSConnToTcp or losing buffered bytes.
+type serverAssoc struct {
+	id  GlobalID
+	reg *serverAssocRegistry
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	conn        net.Conn
+	txBuf       *ringBuffer
+	rxSeq       uint64
+	closed      bool
+	expireTimer *time.Timer
+}
+
+func newServerAssoc(id GlobalID, reg *serverAssocRegistry) *serverAssoc {
+	a := &serverAssoc{id: id, reg: reg, txBuf: &ringBuffer{}}
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+// rxSeqSnapshot returns the association's current rxSeq. The caller must
+// use this to ack a RESUME *before* calling attach, since attach may write
+// a replay payload straight onto conn - acking after that would leave the
+// peer unable to tell where the ack ends and the replay begins.
+func (a *serverAssoc) rxSeqSnapshot() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rxSeq
+}
+
+// attach installs conn as the association's active stream, replaying any
+// bytes written since fromSeq so the peer doesn't lose what it missed, and
+// wakes up any Read/Write currently waiting for a stream.
+func (a *serverAssoc) attach(conn net.Conn, fromSeq uint64) error {
+	if a.txBuf.EndSeq() > 0 || fromSeq > 0 {
+		pending, err := a.txBuf.Since(fromSeq)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			if _, err := conn.Write(pending); err != nil {
+				return err
+			}
+		}
+	}
+
+	a.mu.Lock()
+	if a.expireTimer != nil {
+		a.expireTimer.Stop()
+		a.expireTimer = nil
+	}
+	a.conn = conn
+	a.mu.Unlock()
+	a.cond.Broadcast()
+	return nil
+}
+
+// detach clears the active stream after it breaks and arms the GC timer;
+// the association is closed and removed from the registry if it isn't
+// resumed within resumeAssocTTL.
+func (a *serverAssoc) detach() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn == nil {
+		return
+	}
+	a.conn = nil
+	if a.expireTimer == nil {
+		a.expireTimer = time.AfterFunc(resumeAssocTTL, func() {
+			a.Close()
+		})
+	}
+}
+
+func (a *serverAssoc) waitForConn() (net.Conn, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.conn == nil && !a.closed {
+		a.cond.Wait()
+	}
+	return a.conn, a.closed
+}
+
+func (a *serverAssoc) peekConn() net.Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conn
+}
+
+func (a *serverAssoc) Read(p []byte) (int, error) {
+	for {
+		conn, closed := a.waitForConn()
+		if closed {
+			return 0, net.ErrClosed
+		}
+		n, err := conn.Read(p)
+		if n > 0 {
+			a.mu.Lock()
+			a.rxSeq += uint64(n)
+			a.mu.Unlock()
+			return n, nil
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		Logger.Infof("[mwss] stream %s read error, waiting for resume: %s", a.id, err)
+		a.detach()
+	}
+}
+
+func (a *serverAssoc) Write(p []byte) (int, error) {
+	total := 0
+	for total < len(p) {
+		conn, closed := a.waitForConn()
+		if closed {
+			return total, net.ErrClosed
+		}
+		n, err := conn.Write(p[total:])
+		if n > 0 {
+			a.txBuf.Write(p[total : total+n])
+			total += n
+		}
+		if err == nil {
+			continue
+		}
+		Logger.Infof("[mwss] stream %s write error, waiting for resume: %s", a.id, err)
+		a.detach()
+	}
+	return total, nil
+}
+
+// Close marks the association closed, wakes any blocked Read/Write, and
+// removes it from the registry so a normally-finished stream doesn't sit
+// in mwssAssocs forever waiting for a RESUME that will never come.
+func (a *serverAssoc) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	conn := a.conn
+	if a.expireTimer != nil {
+		a.expireTimer.Stop()
+	}
+	a.mu.Unlock()
+	a.cond.Broadcast()
+	a.reg.delete(a.id)
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+func (a *serverAssoc) LocalAddr() net.Addr {
+	if c := a.peekConn(); c != nil {
+		return c.LocalAddr()
+	}
+	return nil
+}
+
+func (a *serverAssoc) RemoteAddr() net.Addr {
+	if c := a.peekConn(); c != nil {
+		return c.RemoteAddr()
+	}
+	return nil
+}
+
+func (a *serverAssoc) SetDeadline(t time.Time) error      { return nil }
+func (a *serverAssoc) SetReadDeadline(t time.Time) error  { return nil }
+func (a *serverAssoc) SetWriteDeadline(t time.Time) error { return nil }
+
+// serverAssocRegistry tracks every in-flight resumable association on the
+// server side, keyed by GlobalID.
+type serverAssocRegistry struct {
+	mu     sync.Mutex
+	assocs map[GlobalID]*serverAssoc
+}
+
+var mwssAssocs = &serverAssocRegistry{assocs: make(map[GlobalID]*serverAssoc)}
+
+func (reg *serverAssocRegistry) create(id GlobalID) *serverAssoc {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	a := newServerAssoc(id, reg)
+	reg.assocs[id] = a
+	return a
+}
+
+func (reg *serverAssocRegistry) get(id GlobalID) (*serverAssoc, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	a, ok := reg.assocs[id]
+	return a, ok
+}
+
+func (reg *serverAssocRegistry) delete(id GlobalID) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.assocs, id)
+}
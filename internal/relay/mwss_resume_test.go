@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// TestRouteResumableStreamResumeAcksBeforeReplay guards against a server
+// that writes a RESUME's replay payload onto the wire before the rxSeq ack
+// that must precede it: without that ordering the client's handshake
+// reader misreads the first 8 bytes of replayed data as the ack instead of
+// the real one, silently corrupting both.
+func TestRouteResumableStreamResumeAcksBeforeReplay(t *testing.T) {
+	id, err := newGlobalID()
+	if err != nil {
+		t.Fatalf("newGlobalID: %v", err)
+	}
+
+	s := &MWSSServer{connChan: make(chan net.Conn, 1)}
+
+	// Open the logical stream for the first time.
+	origServer, origClient := net.Pipe()
+	defer origServer.Close()
+	defer origClient.Close()
+	go s.routeResumableStream(origServer)
+	if err := writeHandshake(origClient, frameKindNew, id, 0); err != nil {
+		t.Fatalf("writeHandshake NEW: %v", err)
+	}
+	assocConn := <-s.connChan
+	assoc, ok := assocConn.(*serverAssoc)
+	if !ok {
+		t.Fatalf("connChan delivered %T, want *serverAssoc", assocConn)
+	}
+
+	// The backend already wrote some bytes toward the client before the
+	// stream broke; they land in assoc's txBuf for possible replay.
+	toClient := []byte("hello from backend")
+	writeDone := make(chan error, 1)
+	go func() {
+		_, werr := assoc.Write(toClient)
+		writeDone <- werr
+	}()
+	gotToClient := make([]byte, len(toClient))
+	if _, err := io.ReadFull(origClient, gotToClient); err != nil {
+		t.Fatalf("read toClient: %v", err)
+	}
+	if err := <-writeDone; err != nil {
+		t.Fatalf("assoc.Write: %v", err)
+	}
+
+	// The client already sent some bytes toward the backend too, bumping
+	// the association's own rxSeq - this is what the resume ack reports.
+	fromClient := []byte("hi server")
+	go origClient.Write(fromClient)
+	gotFromClient := make([]byte, len(fromClient))
+	if _, err := assoc.Read(gotFromClient); err != nil {
+		t.Fatalf("assoc.Read: %v", err)
+	}
+
+	// Simulate the underlying stream breaking, the way a failed Read/Write
+	// inside assoc's own loop would.
+	assoc.detach()
+
+	// Resume it, claiming the client has received nothing from the server
+	// yet, so the full toClient buffer must be replayed.
+	resumeServer, resumeClient := net.Pipe()
+	defer resumeServer.Close()
+	defer resumeClient.Close()
+	go s.routeResumableStream(resumeServer)
+	if err := writeHandshake(resumeClient, frameKindResume, id, 0); err != nil {
+		t.Fatalf("writeHandshake RESUME: %v", err)
+	}
+
+	ackSeq, err := readResumeAck(resumeClient)
+	if err != nil {
+		t.Fatalf("readResumeAck: %v", err)
+	}
+	if ackSeq != uint64(len(fromClient)) {
+		t.Fatalf("resume ack = %d, want %d", ackSeq, len(fromClient))
+	}
+
+	replayed := make([]byte, len(toClient))
+	if _, err := io.ReadFull(resumeClient, replayed); err != nil {
+		t.Fatalf("read replay: %v", err)
+	}
+	if string(replayed) != string(toClient) {
+		t.Fatalf("replayed = %q, want %q", replayed, toClient)
+	}
+}
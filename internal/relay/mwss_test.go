@@ -0,0 +1,149 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// fakeMuxSession lets a test control OpenStream/NumStreams bookkeeping
+// directly instead of driving a real smux/yamux/h2 session, so the test can
+// assert on stream counts without racing the mux protocol itself.
+type fakeMuxSession struct {
+	mu      sync.Mutex
+	streams int
+	closeCh chan struct{}
+}
+
+func newFakeMuxSession() *fakeMuxSession {
+	return &fakeMuxSession{closeCh: make(chan struct{})}
+}
+
+func (f *fakeMuxSession) OpenStream() (net.Conn, error) {
+	f.mu.Lock()
+	f.streams++
+	f.mu.Unlock()
+	c, _ := net.Pipe()
+	return c, nil
+}
+func (f *fakeMuxSession) AcceptStream() (net.Conn, error) { <-f.closeCh; return nil, io.EOF }
+func (f *fakeMuxSession) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-f.closeCh:
+	default:
+		close(f.closeCh)
+	}
+	return nil
+}
+func (f *fakeMuxSession) IsClosed() bool {
+	select {
+	case <-f.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+func (f *fakeMuxSession) NumStreams() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.streams
+}
+func (f *fakeMuxSession) CloseChan() <-chan struct{} { return f.closeCh }
+
+// fakeMuxBackend mints a fresh fakeMuxSession per ClientSession/ServerSession
+// call - the same as every real backend (smux/yamux/h2), where a reconnect
+// always starts a new session at 0 streams - and delays ClientSession to
+// widen the window in which concurrent Dials can land inside the same
+// singleflight call, simulating a burst of Dials racing a reconnect during
+// an outage.
+type fakeMuxBackend struct {
+	delay time.Duration
+}
+
+func (fakeMuxBackend) Name() string { return "fake" }
+func (b fakeMuxBackend) ClientSession(conn net.Conn, cfg MuxConfig) (MuxSession, error) {
+	time.Sleep(b.delay)
+	return newFakeMuxSession(), nil
+}
+func (b fakeMuxBackend) ServerSession(conn net.Conn, cfg MuxConfig) (MuxSession, error) {
+	return newFakeMuxSession(), nil
+}
+
+// TestDialCapsStreamsPerSessionUnderReconnectBurst guards against
+// getOrInitSession handing the same reconnected session to every Dial
+// blocked on it (singleflight collapses them to one initSession call)
+// without each caller re-checking capacity: without that re-check, a burst
+// of concurrent Dials can push a single session's stream count past
+// maxStreamCnt.
+func TestDialCapsStreamsPerSessionUnderReconnectBurst(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	addr := "ws://" + strings.TrimPrefix(ts.URL, "http://") + "/"
+	backend := fakeMuxBackend{delay: 50 * time.Millisecond}
+	tr := NewMWSSTransporter()
+
+	const maxStreamCnt = 3
+	const concurrency = 10
+	var wg sync.WaitGroup
+	conns := make([]net.Conn, concurrency)
+	errs := make([]error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conns[i], errs[i] = tr.Dial(addr, maxStreamCnt, nil, backend)
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Dial calls did not complete in time")
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Dial %d: %v", i, err)
+		}
+	}
+	for _, c := range conns {
+		if c != nil {
+			c.Close()
+		}
+	}
+
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	for _, s := range tr.sessions[addr] {
+		if n := s.NumStreams(); n > maxStreamCnt {
+			t.Fatalf("session opened %d streams, want <= %d", n, maxStreamCnt)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package relay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMWSSUDPPath is the server-side mux pattern UDP-over-MWSS
+	// associations upgrade through.
+	DefaultMWSSUDPPath = "/udp/"
+
+	// udpAssocIdleTimeout tears an association down once no packet has
+	// crossed it in either direction for this long.
+	udpAssocIdleTimeout = 60 * time.Second
+
+	// maxUDPPacketSize bounds a single length-prefixed frame's payload. It
+	// must not exceed math.MaxUint16: writeUDPFrame packs the payload
+	// length into a uint16, and a 65536-byte payload would wrap to 0 and
+	// desync that stream's framing.
+	maxUDPPacketSize = 65535
+)
+
+// udpAssoc binds one client source address to the smux stream carrying its
+// traffic over the MWSS tunnel.
+type udpAssoc struct {
+	stream net.Conn
+	timer  *time.Timer
+}
+
+// handleUdpOverMWSS bridges a local UDP listener over the MWSS tunnel,
+// opening one smux stream per distinct client source address and reusing it
+// for as long as that client keeps sending packets.
+func (r *Relay) handleUdpOverMWSS(lc *net.UDPConn) {
+	assocs := &sync.Map{} // src addr string -> *udpAssoc
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, srcAddr, err := lc.ReadFromUDP(buf)
+		if err != nil {
+			Logger.Infof("handleUdpOverMWSS read error: %s", err)
+			return
+		}
+		payload := make([]byte, n)
+		copy(payload, buf[:n])
+
+		assoc := r.getOrCreateUDPAssoc(assocs, lc, srcAddr)
+		if assoc == nil {
+			continue
+		}
+		if err := writeUDPFrame(assoc.stream, payload); err != nil {
+			Logger.Infof("handleUdpOverMWSS write error: %s", err)
+			assocs.Delete(srcAddr.String())
+			assoc.timer.Stop()
+			assoc.stream.Close()
+			continue
+		}
+		assoc.timer.Reset(udpAssocIdleTimeout)
+	}
+}
+
+func (r *Relay) getOrCreateUDPAssoc(assocs *sync.Map, lc *net.UDPConn, srcAddr *net.UDPAddr) *udpAssoc {
+	key := srcAddr.String()
+	if v, ok := assocs.Load(key); ok {
+		return v.(*udpAssoc)
+	}
+
+	udpPath := r.UDPPath
+	if udpPath == "" {
+		udpPath = DefaultMWSSUDPPath
+	}
+	backend, addr := muxBackendFromRemote(r.RemoteTCPAddr + udpPath + r.muxQuery())
+	stream, err := tr.Dial(addr, r.MaxStreamCnt, r.TLSConfig, backend)
+	if err != nil {
+		Logger.Infof("handleUdpOverMWSS dial error: %s", err)
+		return nil
+	}
+
+	assoc := &udpAssoc{stream: stream}
+	assoc.timer = time.AfterFunc(udpAssocIdleTimeout, func() {
+		assocs.Delete(key)
+		stream.Close()
+	})
+	assocs.Store(key, assoc)
+
+	go r.pumpUDPAssocReplies(lc, srcAddr, assoc, assocs, key)
+	return assoc
+}
+
+// pumpUDPAssocReplies reads framed datagrams coming back over assoc.stream
+// and writes them to the original client. It evicts the association from
+// assocs as soon as the underlying smux stream closes.
+func (r *Relay) pumpUDPAssocReplies(lc *net.UDPConn, srcAddr *net.UDPAddr, assoc *udpAssoc, assocs *sync.Map, key string) {
+	defer func() {
+		assocs.Delete(key)
+		assoc.timer.Stop()
+		assoc.stream.Close()
+	}()
+	for {
+		payload, err := readUDPFrame(assoc.stream)
+		if err != nil {
+			return
+		}
+		if _, err := lc.WriteToUDP(payload, srcAddr); err != nil {
+			Logger.Infof("handleUdpOverMWSS write to client error: %s", err)
+			return
+		}
+		assoc.timer.Reset(udpAssocIdleTimeout)
+	}
+}
+
+// handleMWSSStreamToUdp is the server-side counterpart of
+// handleUdpOverMWSS: it dials the UDP target once per accepted stream and
+// shuttles framed datagrams in both directions until either side closes.
+func handleMWSSStreamToUdp(stream net.Conn, remoteUDPAddr string) {
+	defer stream.Close()
+	rc, err := net.Dial("udp", remoteUDPAddr)
+	if err != nil {
+		Logger.Infof("handleMWSSStreamToUdp dial error: %s", err)
+		return
+	}
+	defer rc.Close()
+
+	go func() {
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, err := rc.Read(buf)
+			if err != nil {
+				return
+			}
+			if err := writeUDPFrame(stream, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		payload, err := readUDPFrame(stream)
+		if err != nil {
+			return
+		}
+		if _, err := rc.Write(payload); err != nil {
+			return
+		}
+	}
+}
+
+// writeUDPFrame / readUDPFrame frame a UDP datagram as `uint16 len |
+// payload` so it can ride a byte-oriented smux stream.
+func writeUDPFrame(w net.Conn, payload []byte) error {
+	if len(payload) > maxUDPPacketSize {
+		return fmt.Errorf("mwss-udp: payload of %d bytes exceeds max frame size %d", len(payload), maxUDPPacketSize)
+	}
+	hdr := make([]byte, 2)
+	binary.BigEndian.PutUint16(hdr, uint16(len(payload)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readUDPFrame(r net.Conn) ([]byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint16(hdr)
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
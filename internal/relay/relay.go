@@ -0,0 +1,36 @@
+package relay
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Relay holds one relay's wiring: where it listens, where it forwards to,
+// and the per-relay overrides the MWSS transport accepts instead of falling
+// back to its package-level defaults.
+type Relay struct {
+	LocalTCPAddr  *net.TCPAddr
+	RemoteTCPAddr string
+
+	// WSSPath / UDPPath override DefaultMWSSPath / DefaultMWSSUDPPath for
+	// this relay, so multiple MWSS relays behind the same host/reverse
+	// proxy can each claim a distinct upgrade endpoint. Empty uses the
+	// package default.
+	WSSPath string
+	UDPPath string
+
+	// MaxStreamCnt caps how many multiplexed streams one MWSS session for
+	// this relay may carry. It is clamped to [MinMWSSStreamCnt,
+	// MaxMWSSStreamCntLimit] by clampMaxStreamCnt; <= 0 uses
+	// MaxMWSSStreamCnt.
+	MaxStreamCnt int
+
+	// TLSConfig overrides DefaultTLSConfig for this relay's MWSS transport,
+	// e.g. to pin a client cert or a non-default CA pool. nil uses the
+	// package default.
+	TLSConfig *tls.Config
+
+	// Mux selects the mux backend (smux, yamux, h2) this relay's MWSS
+	// transport negotiates. Empty uses defaultMuxBackend.
+	Mux string
+}